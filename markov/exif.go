@@ -0,0 +1,194 @@
+package markov
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+)
+
+// Exif orientation tag values (Exif 2.3 section 4.6.4, tag 0x0112). Only
+// 1-8 are valid; orientationNone is our own sentinel for "no tag found".
+const (
+	orientationNone           = 0
+	orientationNormal         = 1
+	orientationFlipHorizontal = 2
+	orientationRotate180      = 3
+	orientationFlipVertical   = 4
+	orientationTranspose      = 5
+	orientationRotate90CW     = 6
+	orientationTransverse     = 7
+	orientationRotate270CW    = 8
+)
+
+// readExifOrientation scans raw image bytes for an embedded Exif orientation
+// tag, checking both a JPEG APP1 segment and a PNG eXIf chunk, and returns
+// orientationNone if neither is present or the data can't be parsed.
+func readExifOrientation(data []byte) int {
+	if o := jpegExifOrientation(data); o != orientationNone {
+		return o
+	}
+	return pngExifOrientation(data)
+}
+
+// jpegExifOrientation walks a JPEG's marker segments looking for an APP1
+// segment carrying an "Exif\0\0" header, and returns its orientation tag.
+func jpegExifOrientation(data []byte) int {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return orientationNone
+	}
+	for i := 2; i+4 <= len(data); {
+		if data[i] != 0xFF {
+			break
+		}
+		marker := data[i+1]
+		if marker == 0xD8 || marker == 0xD9 || (marker >= 0xD0 && marker <= 0xD7) {
+			// markers with no payload (SOI/EOI/RSTn)
+			i += 2
+			continue
+		}
+		if marker == 0xDA {
+			// start of scan; no more metadata markers follow
+			break
+		}
+		segLen := int(binary.BigEndian.Uint16(data[i+2 : i+4]))
+		if segLen < 2 || i+2+segLen > len(data) {
+			break
+		}
+		if marker == 0xE1 { // APP1
+			seg := data[i+4 : i+2+segLen]
+			if len(seg) >= 6 && string(seg[0:6]) == "Exif\x00\x00" {
+				return parseTIFFOrientation(seg[6:])
+			}
+		}
+		i += 2 + segLen
+	}
+	return orientationNone
+}
+
+// pngPhysicalSignature is the 8-byte magic that opens every PNG file.
+var pngPhysicalSignature = []byte{0x89, 'P', 'N', 'G', '\r', '\n', 0x1a, '\n'}
+
+// pngExifOrientation walks a PNG's chunks looking for an "eXIf" ancillary
+// chunk, and returns its orientation tag.
+func pngExifOrientation(data []byte) int {
+	if len(data) < len(pngPhysicalSignature) ||
+		!bytes.Equal(data[:len(pngPhysicalSignature)], pngPhysicalSignature) {
+		return orientationNone
+	}
+	for i := len(pngPhysicalSignature); i+8 <= len(data); {
+		length := int(binary.BigEndian.Uint32(data[i : i+4]))
+		typ := string(data[i+4 : i+8])
+		chunkData := i + 8
+		if length < 0 || chunkData+length > len(data) {
+			break
+		}
+		if typ == "eXIf" {
+			return parseTIFFOrientation(data[chunkData : chunkData+length])
+		}
+		if typ == "IDAT" {
+			// pixel data; a conforming PNG places eXIf before the first IDAT
+			break
+		}
+		i = chunkData + length + 4 // skip the trailing CRC
+	}
+	return orientationNone
+}
+
+// parseTIFFOrientation reads a TIFF-structured Exif blob (byte-order mark,
+// IFD0 offset, IFD0 entries) and returns the value of its Orientation tag
+// (0x0112), or orientationNone if the tag is absent or the blob is malformed.
+func parseTIFFOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return orientationNone
+	}
+	var bo binary.ByteOrder
+	switch string(tiff[0:2]) {
+	case "II":
+		bo = binary.LittleEndian
+	case "MM":
+		bo = binary.BigEndian
+	default:
+		return orientationNone
+	}
+	if bo.Uint16(tiff[2:4]) != 42 {
+		return orientationNone
+	}
+	ifdOffset := bo.Uint32(tiff[4:8])
+	if int(ifdOffset)+2 > len(tiff) {
+		return orientationNone
+	}
+	count := int(bo.Uint16(tiff[ifdOffset : ifdOffset+2]))
+	entries := tiff[ifdOffset+2:]
+	const entrySize = 12
+	for i := 0; i < count; i++ {
+		off := i * entrySize
+		if off+entrySize > len(entries) {
+			break
+		}
+		entry := entries[off : off+entrySize]
+		const orientationTag = 0x0112
+		const shortType = 3
+		if bo.Uint16(entry[0:2]) != orientationTag {
+			continue
+		}
+		if bo.Uint16(entry[2:4]) != shortType {
+			return orientationNone
+		}
+		value := bo.Uint16(entry[8:10])
+		if value < 1 || value > 8 {
+			return orientationNone
+		}
+		return int(value)
+	}
+	return orientationNone
+}
+
+// orientSourceCoord maps a destination pixel (dx, dy) of an auto-oriented
+// image back to the source pixel it is drawn from, given the source's
+// dimensions (srcW, srcH) and the Exif orientation correcting it.
+func orientSourceCoord(orientation, dx, dy, srcW, srcH int) (int, int) {
+	switch orientation {
+	case orientationFlipHorizontal:
+		return srcW - 1 - dx, dy
+	case orientationRotate180:
+		return srcW - 1 - dx, srcH - 1 - dy
+	case orientationFlipVertical:
+		return dx, srcH - 1 - dy
+	case orientationTranspose:
+		return dy, dx
+	case orientationRotate90CW:
+		return dy, srcH - 1 - dx
+	case orientationTransverse:
+		return srcW - 1 - dy, srcH - 1 - dx
+	case orientationRotate270CW:
+		return srcW - 1 - dy, dx
+	default: // orientationNone, orientationNormal
+		return dx, dy
+	}
+}
+
+// autoOrient returns img rotated/flipped to correct for the given Exif
+// orientation, so that trained context directions (N/W/NW/NE) are meaningful
+// regardless of how the source file was physically stored. It always
+// rebuilds into an *image.RGBA, so a paletted source loses its fast path
+// when it actually needs reorienting; untouched (orientationNormal/None)
+// images are returned as-is.
+func autoOrient(img image.Image, orientation int) image.Image {
+	if orientation == orientationNone || orientation == orientationNormal {
+		return img
+	}
+	b := img.Bounds()
+	srcW, srcH := b.Dx(), b.Dy()
+	dstW, dstH := srcW, srcH
+	if orientation >= orientationTranspose { // 5-8 swap width and height
+		dstW, dstH = srcH, srcW
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dstW, dstH))
+	for dy := 0; dy < dstH; dy++ {
+		for dx := 0; dx < dstW; dx++ {
+			sx, sy := orientSourceCoord(orientation, dx, dy, srcW, srcH)
+			dst.Set(dx, dy, img.At(b.Min.X+sx, b.Min.Y+sy))
+		}
+	}
+	return dst
+}
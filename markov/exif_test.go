@@ -0,0 +1,322 @@
+package markov
+
+import (
+	"encoding/binary"
+	"image"
+	"image/color"
+	"testing"
+)
+
+// buildTIFFOrientation returns a minimal TIFF-structured Exif blob (byte-order
+// mark, IFD0 offset, a single Orientation entry) encoding the given
+// orientation value, using bo as its byte order.
+func buildTIFFOrientation(bo binary.ByteOrder, orientation uint16) []byte {
+	buf := make([]byte, 8+2+12+4)
+	if bo == binary.LittleEndian {
+		copy(buf[0:2], "II")
+	} else {
+		copy(buf[0:2], "MM")
+	}
+	bo.PutUint16(buf[2:4], 42)
+	bo.PutUint32(buf[4:8], 8)  // IFD0 offset
+	bo.PutUint16(buf[8:10], 1) // one IFD entry
+	entry := buf[10:22]
+	bo.PutUint16(entry[0:2], 0x0112) // Orientation tag
+	bo.PutUint16(entry[2:4], 3)      // SHORT type
+	bo.PutUint32(entry[4:8], 1)      // count
+	bo.PutUint16(entry[8:10], orientation)
+	return buf
+}
+
+func TestParseTIFFOrientation(t *testing.T) {
+	for orientation := uint16(1); orientation <= 8; orientation++ {
+		for _, bo := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+			tiff := buildTIFFOrientation(bo, orientation)
+			if got := parseTIFFOrientation(tiff); got != int(orientation) {
+				t.Errorf("parseTIFFOrientation(%v, orientation=%d) = %d, want %d", bo, orientation, got, orientation)
+			}
+		}
+	}
+}
+
+func TestParseTIFFOrientationMalformed(t *testing.T) {
+	valid := buildTIFFOrientation(binary.LittleEndian, 6)
+	cases := map[string][]byte{
+		"too short":        {0x49, 0x49},
+		"bad byte order":   append([]byte("XX"), valid[2:]...),
+		"bad magic number": func() []byte { b := append([]byte(nil), valid...); binary.LittleEndian.PutUint16(b[2:4], 99); return b }(),
+		"ifd offset beyond": func() []byte {
+			b := append([]byte(nil), valid...)
+			binary.LittleEndian.PutUint32(b[4:8], 9999)
+			return b
+		}(),
+		"truncated entries": valid[:12],
+		"wrong entry type": func() []byte {
+			b := append([]byte(nil), valid...)
+			binary.LittleEndian.PutUint16(b[12:14], 5) // not SHORT
+			return b
+		}(),
+		"out of range value": func() []byte {
+			b := append([]byte(nil), valid...)
+			binary.LittleEndian.PutUint16(b[18:20], 99)
+			return b
+		}(),
+		"no orientation tag": func() []byte {
+			b := append([]byte(nil), valid...)
+			binary.LittleEndian.PutUint16(b[10:12], 0x0111)
+			return b
+		}(),
+	}
+	for name, data := range cases {
+		if got := parseTIFFOrientation(data); got != orientationNone {
+			t.Errorf("%s: parseTIFFOrientation = %d, want orientationNone", name, got)
+		}
+	}
+}
+
+// buildJPEGWithExif returns a minimal JPEG byte stream (SOI, an APP1 segment
+// carrying tiff as its Exif payload, then an SOS marker) for exercising
+// jpegExifOrientation.
+func buildJPEGWithExif(tiff []byte) []byte {
+	payload := append([]byte("Exif\x00\x00"), tiff...)
+	segLen := len(payload) + 2
+	app1 := []byte{0xFF, 0xE1, byte(segLen >> 8), byte(segLen)}
+	app1 = append(app1, payload...)
+	jpeg := []byte{0xFF, 0xD8} // SOI
+	jpeg = append(jpeg, app1...)
+	jpeg = append(jpeg, 0xFF, 0xDA) // SOS (start of scan, parsing stops here)
+	return jpeg
+}
+
+func TestJPEGExifOrientation(t *testing.T) {
+	tiff := buildTIFFOrientation(binary.LittleEndian, 6)
+	jpeg := buildJPEGWithExif(tiff)
+	if got := jpegExifOrientation(jpeg); got != orientationRotate90CW {
+		t.Fatalf("jpegExifOrientation = %d, want %d", got, orientationRotate90CW)
+	}
+}
+
+func TestJPEGExifOrientationMalformed(t *testing.T) {
+	tiff := buildTIFFOrientation(binary.LittleEndian, 6)
+	valid := buildJPEGWithExif(tiff)
+	cases := map[string][]byte{
+		"not a JPEG":            {0x00, 0x01, 0x02, 0x03},
+		"too short":             {0xFF, 0xD8},
+		"truncated APP1 header": valid[:4],
+		"truncated APP1 body":   valid[:len(valid)-10],
+		"APP1 without Exif header": func() []byte {
+			b := []byte{0xFF, 0xD8, 0xFF, 0xE1, 0x00, 0x06, 'j', 'u', 'n', 'k'}
+			return b
+		}(),
+		"no APP1 segment": {0xFF, 0xD8, 0xFF, 0xDA},
+	}
+	for name, data := range cases {
+		if got := jpegExifOrientation(data); got != orientationNone {
+			t.Errorf("%s: jpegExifOrientation = %d, want orientationNone", name, got)
+		}
+	}
+}
+
+// buildPNGWithExif returns a minimal PNG byte stream (signature, an eXIf
+// chunk carrying tiff, an IDAT chunk) for exercising pngExifOrientation.
+func buildPNGWithExif(tiff []byte) []byte {
+	chunk := func(typ string, data []byte) []byte {
+		b := make([]byte, 4)
+		binary.BigEndian.PutUint32(b, uint32(len(data)))
+		b = append(b, []byte(typ)...)
+		b = append(b, data...)
+		b = append(b, 0, 0, 0, 0) // CRC, unchecked by pngExifOrientation
+		return b
+	}
+	png := append([]byte(nil), pngPhysicalSignature...)
+	png = append(png, chunk("eXIf", tiff)...)
+	png = append(png, chunk("IDAT", []byte{0x01, 0x02})...)
+	return png
+}
+
+func TestPNGExifOrientation(t *testing.T) {
+	tiff := buildTIFFOrientation(binary.BigEndian, 3)
+	png := buildPNGWithExif(tiff)
+	if got := pngExifOrientation(png); got != orientationRotate180 {
+		t.Fatalf("pngExifOrientation = %d, want %d", got, orientationRotate180)
+	}
+}
+
+func TestPNGExifOrientationMalformed(t *testing.T) {
+	tiff := buildTIFFOrientation(binary.BigEndian, 3)
+	cases := map[string][]byte{
+		"not a PNG":           {0x00, 0x01, 0x02, 0x03},
+		"truncated signature": pngPhysicalSignature[:4],
+		"truncated chunk header": append(
+			append([]byte(nil), pngPhysicalSignature...), 0x00, 0x00,
+		),
+		"chunk length overruns": func() []byte {
+			b := append([]byte(nil), pngPhysicalSignature...)
+			return append(b, 0xFF, 0xFF, 0xFF, 0xFF, 'e', 'X', 'I', 'f')
+		}(),
+		"IDAT precedes eXIf": func() []byte {
+			b := append([]byte(nil), pngPhysicalSignature...)
+			chunk := func(typ string, data []byte) []byte {
+				h := make([]byte, 4)
+				binary.BigEndian.PutUint32(h, uint32(len(data)))
+				h = append(h, []byte(typ)...)
+				h = append(h, data...)
+				return append(h, 0, 0, 0, 0)
+			}
+			b = append(b, chunk("IDAT", []byte{0x01})...)
+			b = append(b, chunk("eXIf", tiff)...)
+			return b
+		}(),
+	}
+	for name, data := range cases {
+		if got := pngExifOrientation(data); got != orientationNone {
+			t.Errorf("%s: pngExifOrientation = %d, want orientationNone", name, got)
+		}
+	}
+}
+
+// rotateMatrix90CW rotates a row-major color matrix 90 degrees clockwise,
+// independent of autoOrient/orientSourceCoord, as a reference to test
+// against.
+func rotateMatrix90CW(src [][]color.Color) [][]color.Color {
+	h, w := len(src), len(src[0])
+	dst := make([][]color.Color, w)
+	for i := range dst {
+		dst[i] = make([]color.Color, h)
+	}
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			dst[x][h-1-y] = src[y][x]
+		}
+	}
+	return dst
+}
+
+func flipHorizontal(src [][]color.Color) [][]color.Color {
+	h, w := len(src), len(src[0])
+	dst := make([][]color.Color, h)
+	for y := 0; y < h; y++ {
+		dst[y] = make([]color.Color, w)
+		for x := 0; x < w; x++ {
+			dst[y][x] = src[y][w-1-x]
+		}
+	}
+	return dst
+}
+
+func flipVertical(src [][]color.Color) [][]color.Color {
+	h := len(src)
+	dst := make([][]color.Color, h)
+	for y := 0; y < h; y++ {
+		dst[y] = src[h-1-y]
+	}
+	return dst
+}
+
+func rotate180(src [][]color.Color) [][]color.Color {
+	return flipVertical(flipHorizontal(src))
+}
+
+func rotate270CW(src [][]color.Color) [][]color.Color {
+	return rotateMatrix90CW(rotateMatrix90CW(rotateMatrix90CW(src)))
+}
+
+func transpose(src [][]color.Color) [][]color.Color {
+	h, w := len(src), len(src[0])
+	dst := make([][]color.Color, w)
+	for x := 0; x < w; x++ {
+		dst[x] = make([]color.Color, h)
+		for y := 0; y < h; y++ {
+			dst[x][y] = src[y][x]
+		}
+	}
+	return dst
+}
+
+func transverse(src [][]color.Color) [][]color.Color {
+	return rotate180(transpose(src))
+}
+
+// newMarkerImage returns a 3x2 *image.RGBA whose pixels are all distinct, so
+// rotations/flips can be detected positionally, plus a row-major matrix of
+// the same colors for computing independent reference transforms.
+func newMarkerImage() (*image.RGBA, [][]color.Color) {
+	const w, h = 3, 2
+	im := image.NewRGBA(image.Rect(0, 0, w, h))
+	matrix := make([][]color.Color, h)
+	for y := 0; y < h; y++ {
+		matrix[y] = make([]color.Color, w)
+		for x := 0; x < w; x++ {
+			c := color.RGBA{R: uint8(y*w + x + 1), G: uint8(x), B: uint8(y), A: 255}
+			im.SetRGBA(x, y, c)
+			matrix[y][x] = c
+		}
+	}
+	return im, matrix
+}
+
+func matrixToImage(t *testing.T, m [][]color.Color) *image.RGBA {
+	t.Helper()
+	h, w := len(m), len(m[0])
+	im := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			im.Set(x, y, m[y][x])
+		}
+	}
+	return im
+}
+
+func imagesEqual(a, b image.Image) bool {
+	ab, bb := a.Bounds(), b.Bounds()
+	if ab.Dx() != bb.Dx() || ab.Dy() != bb.Dy() {
+		return false
+	}
+	for y := 0; y < ab.Dy(); y++ {
+		for x := 0; x < ab.Dx(); x++ {
+			ar, ag, ab2, aa := a.At(ab.Min.X+x, ab.Min.Y+y).RGBA()
+			br, bg, bb2, ba := b.At(bb.Min.X+x, bb.Min.Y+y).RGBA()
+			if ar != br || ag != bg || ab2 != bb2 || aa != ba {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// TestAutoOrient verifies autoOrient against independently-computed
+// reference transforms for every valid orientation value.
+func TestAutoOrient(t *testing.T) {
+	src, matrix := newMarkerImage()
+	cases := []struct {
+		orientation int
+		want        [][]color.Color
+	}{
+		{orientationNormal, matrix},
+		{orientationFlipHorizontal, flipHorizontal(matrix)},
+		{orientationRotate180, rotate180(matrix)},
+		{orientationFlipVertical, flipVertical(matrix)},
+		{orientationTranspose, transpose(matrix)},
+		{orientationRotate90CW, rotateMatrix90CW(matrix)},
+		{orientationTransverse, transverse(matrix)},
+		{orientationRotate270CW, rotate270CW(matrix)},
+	}
+	for _, c := range cases {
+		got := autoOrient(src, c.orientation)
+		want := matrixToImage(t, c.want)
+		if !imagesEqual(got, want) {
+			t.Errorf("autoOrient(orientation=%d): got bounds %v, want bounds %v, equal=false",
+				c.orientation, got.Bounds(), want.Bounds())
+		}
+	}
+}
+
+// TestAutoOrientNoneIsIdentity verifies that orientationNone leaves the image
+// untouched rather than rebuilding it.
+func TestAutoOrientNoneIsIdentity(t *testing.T) {
+	src, _ := newMarkerImage()
+	got := autoOrient(src, orientationNone)
+	if got != image.Image(src) {
+		t.Fatalf("autoOrient(orientationNone) rebuilt the image instead of returning it unchanged")
+	}
+}
@@ -1,146 +1,549 @@
 package markov
 
 import (
+	"bytes"
 	"crypto/rand"
 	"fmt"
 	"image"
 	"image/color"
-	// "image/gif"
-	_ "image/gif"
+	"image/color/palette"
+	"image/gif"
 	// "image/jpeg"
 	_ "image/jpeg"
 	"image/png"
 	_ "image/png"
 	"math/big"
+	mrand "math/rand"
 	"os"
+	"sort"
+	"strings"
+)
+
+const (
+	// DefaultOrder is the context size used by New, conditioning each pixel
+	// on just its west neighbor.
+	DefaultOrder = 1
+
+	// MaxOrder is the largest context size supported; it bounds stateKey and
+	// the length of contextOffsets.
+	MaxOrder = 4
 
-	"github.com/crossedbot/collections/randomstack"
+	// noNeighbor is the sentinel context-slot value for a neighbor that is
+	// out of bounds or has not been coloured yet.
+	noNeighbor = ^uint32(0)
 )
 
 // Markov is an interface to a markov model of an image
 type Markov interface {
-	// GetNextColor returns a randomly selected tranistion color for the given
-	// color.
-	GetNextColor(c color.Color) color.Color
+	// GetNextColor returns a randomly selected transition color for the
+	// given context of already-coloured neighbors, backing off to a
+	// shorter context, and finally to GetRandomColor, when the exact
+	// context was never observed.
+	GetNextColor(context []color.Color) color.Color
 
 	// GetRandomColor returns a randomly selected color from the model.
 	GetRandomColor() color.Color
 
-	// AddColorTransition adds a color transition, c2, for the given color, c1,
-	// to the model.
-	AddColorTransition(c1 color.Color, c2 color.Color)
+	// AddTransition adds an observation to the model: next is the color
+	// observed when the given context of already-coloured neighbors
+	// preceded it.
+	AddTransition(context []color.Color, next color.Color)
 
 	// Generate returns a new image generated from the current model.
-	Generate() *image.RGBA
+	Generate() image.Image
 
-	// ReadFile reads the given image file and sets the model accordingly.
+	// GenerateAnimation returns a GIF built from frames independently
+	// sampled from the current model, each seeded from the previous frame's
+	// last-drawn pixel for temporal continuity, and quantized to a shared
+	// palette derived from the model's colors.
+	GenerateAnimation(frames int, delayCs int) *gif.GIF
+
+	// SetAnimation configures WriteFile to emit an animated GIF of the given
+	// frame count and per-frame delay (in hundredths of a second) whenever
+	// the output filename ends in ".gif". With frames <= 0, the default,
+	// WriteFile produces a single-frame GIF instead.
+	SetAnimation(frames int, delayCs int)
+
+	// ReadFile reads the given image file and adds it to the model.
 	ReadFile(filename string) error
 
+	// ReadFiles reads each given image file and adds it to the model, so a
+	// single model can be trained from a corpus of multiple images.
+	ReadFiles(filenames ...string) error
+
+	// AddImage adds the transitions observed in img to the model.
+	AddImage(img image.Image) error
+
+	// SetBounds explicitly sets the output size used by Generate, overriding
+	// the bounds otherwise inferred as the union of every trained image's
+	// bounds.
+	SetBounds(r image.Rectangle)
+
+	// Merge combines another model's transitions, distinct colors and
+	// boundaries into this one, for combining models trained independently
+	// (e.g. in parallel across goroutines on a large corpus). Both models
+	// must share the same order.
+	Merge(other Markov) error
+
 	// WriteFile generates a new image based on the current model and writes
 	// it to the given file path.
 	WriteFile(filename string) error
+
+	// Order returns the model's context size, IE. the number of
+	// already-coloured neighbors conditioning each pixel.
+	Order() int
+}
+
+// stateKey is the tuple of encoded context-neighbor colors conditioning a
+// pixel, padded with noNeighbor beyond the model's order.
+type stateKey [MaxOrder]uint32
+
+// stateSpace represents a markov state space of an image's colors, keyed by
+// context rather than by a single preceding color so higher-order models can
+// be expressed without changing the map shape. Each context maps to a
+// transitionCounts rather than a slice of observations, so memory is
+// proportional to the number of distinct next colors rather than the number
+// of times the context was observed.
+type stateSpace map[stateKey]*transitionCounts
+
+// transitionCounts tracks, for a single context, how many times each next
+// color was observed, plus a cumulative-weight cache used to do a weighted
+// pick in O(log n) instead of re-scanning the observation counts every time.
+type transitionCounts struct {
+	counts map[uint32]uint32 // next color key -> observation count
+	colors []uint32          // distinct next color keys, sorted, cached
+	cum    []uint32          // cumulative counts parallel to colors, cached
+	total  uint32            // cached sum of counts
+	stale  bool              // true when colors/cum/total need rebuilding
 }
 
-// stateSpace represents a markov state space of an image's colors
-type stateSpace map[uint32][]uint32
+// newTransitionCounts returns an empty transitionCounts.
+func newTransitionCounts() *transitionCounts {
+	return &transitionCounts{counts: make(map[uint32]uint32)}
+}
+
+// observe records one more observation of next following this context.
+func (t *transitionCounts) observe(next uint32) {
+	t.counts[next]++
+	t.stale = true
+}
+
+// empty reports whether this context has no observations.
+func (t *transitionCounts) empty() bool {
+	return len(t.counts) == 0
+}
+
+// ensureFresh rebuilds the cumulative-weight cache if it is stale. The
+// colors are sorted so the cache is deterministic given the same counts,
+// independent of Go's randomized map iteration order.
+func (t *transitionCounts) ensureFresh() {
+	if !t.stale && t.cum != nil {
+		return
+	}
+	t.colors = make([]uint32, 0, len(t.counts))
+	for c := range t.counts {
+		t.colors = append(t.colors, c)
+	}
+	sort.Slice(t.colors, func(i, j int) bool { return t.colors[i] < t.colors[j] })
+	t.cum = make([]uint32, len(t.colors))
+	var running uint32
+	for i, c := range t.colors {
+		running += t.counts[c]
+		t.cum[i] = running
+	}
+	t.total = running
+	t.stale = false
+}
+
+// pick returns the next color key whose cumulative weight range contains
+// draw, via binary search over the cumulative-weight cache. draw must be in
+// [0, t.total).
+func (t *transitionCounts) pick(draw uint32) uint32 {
+	i := sort.Search(len(t.cum), func(i int) bool { return t.cum[i] > draw })
+	return t.colors[i]
+}
+
+// contextOffsets are the relative offsets, in raster-scan priority order, of
+// the neighbors eligible to condition a pixel: west, north, north-west and
+// north-east. All four are always already coloured by the time a raster scan
+// (left-to-right, top-to-bottom) reaches the current pixel, so ReadFile and
+// Generate can share this order without tracking visited state.
+var contextOffsets = []image.Point{
+	image.Point{X: -1, Y: 0},  // W
+	image.Point{X: 0, Y: -1},  // N
+	image.Point{X: -1, Y: -1}, // NW
+	image.Point{X: 1, Y: -1},  // NE
+}
+
+// RNG is the source of randomness used to pick starting colors and weighted
+// transitions. Swapping in a seeded implementation makes Generate
+// reproducible, which the default crypto/rand-backed implementation cannot
+// be.
+type RNG interface {
+	// Intn returns a non-negative random integer in [0, n).
+	Intn(n int) int
+}
+
+// cryptoRNG is the default RNG, backed by crypto/rand; it cannot be seeded.
+type cryptoRNG struct{}
+
+// Intn returns a non-negative random integer in [0, n).
+func (cryptoRNG) Intn(n int) int {
+	i, _ := rand.Int(rand.Reader, big.NewInt(int64(n)))
+	return int(i.Int64())
+}
+
+// mathRNG adapts a seeded *mrand.Rand to RNG.
+type mathRNG struct {
+	r *mrand.Rand
+}
+
+// Intn returns a non-negative random integer in [0, n).
+func (m mathRNG) Intn(n int) int {
+	return m.r.Intn(n)
+}
 
 // markov represents a markov model of an image
 type markov struct {
-	keys   []uint32        // encoded color keys of all distinct colors in the image
-	model  stateSpace      // the state space of the image's colors
-	format string          // the image's file format
-	bounds image.Rectangle // the boundaries of the image
-}
+	order   int             // the number of context neighbors conditioning each pixel
+	keys    []uint32        // encoded color keys of all distinct colors in the image
+	seen    map[uint32]bool // set of colors already recorded in keys
+	model   stateSpace      // the state space of the image's colors
+	format  string          // the image's file format
+	bounds  image.Rectangle // the boundaries of the image
+	palette color.Palette   // the source image's palette, if it was paletted
+	rng     RNG             // the source of randomness for GetNextColor/GetRandomColor
 
-// adjacent are the relative difference between a given point and its directly
-// adjacent points. IE. top, bottom, left, right.
-var adjacent = []image.Point{
-	image.Point{X: -1, Y: 0},
-	image.Point{X: 0, Y: -1},
-	image.Point{X: 1, Y: 0},
-	image.Point{X: 0, Y: 1},
+	boundsSet    bool           // true once bounds have been inferred from a trained image or set explicitly
+	boundsLocked bool           // true once SetBounds was called; AddImage then leaves bounds alone
+	formatCounts map[string]int // observed file format -> number of images trained with it
+
+	animFrames int // frame count for an animated GIF; <= 0 means single-frame
+	animDelay  int // per-frame delay, in hundredths of a second, for an animated GIF
 }
 
-// New returns a new Markov instance.
+// New returns a new Markov instance using DefaultOrder, with generation
+// seeded from crypto/rand.
 func New() Markov {
-	return &markov{model: make(stateSpace)}
+	return NewWithOrder(DefaultOrder)
+}
+
+// NewWithOrder returns a new Markov instance conditioning each pixel on the
+// given number of already-coloured context neighbors (see contextOffsets),
+// with generation seeded from crypto/rand. The order is clamped to
+// [1, MaxOrder].
+func NewWithOrder(order int) Markov {
+	return newMarkov(order, cryptoRNG{})
+}
+
+// NewWithSeed returns a new Markov instance using DefaultOrder, whose
+// generation is driven by a math/rand source seeded with the given value, so
+// Generate's output is reproducible across runs.
+func NewWithSeed(seed int64) Markov {
+	return newMarkov(DefaultOrder, mathRNG{mrand.New(mrand.NewSource(seed))})
 }
 
-// GetNextColor returns a randomly selected tranistion color for the given
-// color.
-func (m *markov) GetNextColor(c color.Color) color.Color {
-	key := encodeColor(c)
-	if values, ok := m.model[key]; ok {
-		i, _ := rand.Int(rand.Reader, big.NewInt(int64(len(values))))
-		return decodeColor(values[int(i.Int64())])
+// newMarkov returns a new Markov instance using order (clamped to
+// [1, MaxOrder]) and rng as its source of randomness.
+func newMarkov(order int, rng RNG) *markov {
+	if order < 1 {
+		order = 1
 	}
-	return nil
+	if order > MaxOrder {
+		order = MaxOrder
+	}
+	return &markov{
+		order: order,
+		rng:   rng,
+		seen:  make(map[uint32]bool),
+		model: make(stateSpace),
+	}
+}
+
+// Order returns the model's context size.
+func (m *markov) Order() int {
+	return m.order
+}
+
+// SetAnimation configures WriteFile to emit an animated GIF of the given
+// frame count and per-frame delay (in hundredths of a second) whenever the
+// output filename ends in ".gif". With frames <= 0, the default, WriteFile
+// produces a single-frame GIF instead.
+func (m *markov) SetAnimation(frames int, delayCs int) {
+	m.animFrames = frames
+	m.animDelay = delayCs
+}
+
+// SetBounds explicitly sets the output size used by Generate, overriding the
+// bounds otherwise inferred as the union of every trained image's bounds.
+func (m *markov) SetBounds(r image.Rectangle) {
+	m.bounds = r
+	m.boundsSet = true
+	m.boundsLocked = true
+}
+
+// GetNextColor returns a randomly selected transition color for the given
+// context, backing off to shorter contexts and finally to GetRandomColor when
+// the exact context was never observed.
+func (m *markov) GetNextColor(context []color.Color) color.Color {
+	key := m.contextKey(context)
+	for {
+		if entry := m.model[key]; entry != nil && !entry.empty() {
+			entry.ensureFresh()
+			draw := m.rng.Intn(int(entry.total))
+			return m.decodeColor(entry.pick(uint32(draw)))
+		}
+		next, ok := backoff(key)
+		if !ok {
+			break
+		}
+		key = next
+	}
+	return m.GetRandomColor()
 }
 
 // GetRandomColor returns a randomly selected color from the model.
 func (m *markov) GetRandomColor() color.Color {
-	i, _ := rand.Int(rand.Reader, big.NewInt(int64(len(m.keys))))
-	return decodeColor(m.keys[int(i.Int64())])
+	if len(m.keys) == 0 {
+		return nil
+	}
+	return m.decodeColor(m.keys[m.rng.Intn(len(m.keys))])
 }
 
-// AddColorTransition adds a color transition, c2, for the given color, c1, to
-// the model.
-func (m *markov) AddColorTransition(c1 color.Color, c2 color.Color) {
-	key1 := encodeColor(c1)
-	key2 := encodeColor(c2)
-	if _, ok := m.model[key1]; !ok {
-		m.keys = append(m.keys, key1)
+// AddTransition adds an observation to the model: next is the color observed
+// when the given context of already-coloured neighbors preceded it.
+func (m *markov) AddTransition(context []color.Color, next color.Color) {
+	key := m.contextKey(context)
+	nextKey := m.encodeColor(next)
+	if !m.seen[nextKey] {
+		m.seen[nextKey] = true
+		m.keys = append(m.keys, nextKey)
+	}
+	entry, ok := m.model[key]
+	if !ok {
+		entry = newTransitionCounts()
+		m.model[key] = entry
 	}
-	m.model[key1] = append(m.model[key1], key2)
+	entry.observe(nextKey)
+}
+
+// contextKey encodes the given context colors, in context-offset order, into
+// a stateKey. Missing (nil) context entries, or entries shorter than the
+// model's order, are recorded as noNeighbor.
+func (m *markov) contextKey(context []color.Color) stateKey {
+	var key stateKey
+	for i := range key {
+		key[i] = noNeighbor
+	}
+	for i := 0; i < m.order && i < len(context); i++ {
+		if context[i] != nil {
+			key[i] = m.encodeColor(context[i])
+		}
+	}
+	return key
+}
+
+// backoff returns a copy of key with its most specific (rightmost set)
+// context slot cleared to noNeighbor, for use when the exact context was
+// never observed. ok is false once every slot is already noNeighbor.
+func backoff(key stateKey) (stateKey, bool) {
+	for i := len(key) - 1; i >= 0; i-- {
+		if key[i] != noNeighbor {
+			key[i] = noNeighbor
+			return key, true
+		}
+	}
+	return key, false
+}
+
+// encodeColor encodes the given color to its state space key, keying by
+// palette index instead of packed RGBA when the model was trained from a
+// paletted image.
+func (m *markov) encodeColor(c color.Color) uint32 {
+	if m.palette != nil {
+		return uint32(m.palette.Index(c))
+	}
+	return encodeColor(c)
+}
+
+// decodeColor decodes the given state space key back to a color, resolving
+// palette indices against the model's palette when it was trained from a
+// paletted image.
+func (m *markov) decodeColor(i uint32) color.Color {
+	if m.palette != nil {
+		return m.palette[i]
+	}
+	return decodeColor(i)
 }
 
 // Generate returns a new image generated from the current model.
-func (m *markov) Generate() *image.RGBA {
-	im := image.NewRGBA(image.Rect(m.MinX(), m.MinY(), m.MaxX(), m.MaxY()))
-	stack := randomstack.New()
-	x, _ := rand.Int(rand.Reader, big.NewInt(int64(m.MaxX())))
-	y, _ := rand.Int(rand.Reader, big.NewInt(int64(m.MaxY())))
-	p := image.Point{
-		X: int(x.Int64()),
-		Y: int(y.Int64()),
-	}
-	// add psuedo-random starting point to the new image
-	c := m.GetRandomColor()
-	im.SetRGBA(p.X, p.Y, colorToRGBA(c))
-	stack.Push(p)
-	// for each colored point in the stack, get its color, and set all adjacent
-	// points to a new color
-	for stack.Len() > 0 {
-		// pop a randomly selected colored point
-		p = stack.Pop().(image.Point)
-		c = im.At(p.X, p.Y)
-		for _, adj := range adjacent {
-			p_ := p.Add(adj)
-			if p_.X >= m.MinX() && p_.X < m.MaxX() &&
-				p_.Y >= m.MinY() && p_.Y < m.MaxY() {
-				if im.Pix[im.PixOffset(p_.X, p_.Y)] == 0 {
-					// if the adjacent point fits within the image boundaries
-					// and has not been set a color value: get the next color,
-					// set the point's color, and add it to the stack for later
-					// processing
-					c = m.GetNextColor(c)
-					im.SetRGBA(p_.X, p_.Y, colorToRGBA(c))
-					stack.Push(p_)
-				}
+func (m *markov) Generate() image.Image {
+	return m.generate(nil)
+}
+
+// GenerateAnimation returns a GIF built from frames independently sampled
+// from the current model, each seeded from the previous frame's last-drawn
+// pixel for temporal continuity, and quantized to a shared palette derived
+// from the model's colors.
+func (m *markov) GenerateAnimation(frames int, delayCs int) *gif.GIF {
+	p := m.framePalette()
+	g := &gif.GIF{LoopCount: 0}
+	var seed color.Color
+	for i := 0; i < frames; i++ {
+		frame := m.generate(seed)
+		g.Image = append(g.Image, quantizeFrame(frame, p))
+		g.Delay = append(g.Delay, delayCs)
+		seed = lastPixel(frame)
+	}
+	return g
+}
+
+// framePalette returns the shared palette used to quantize animation frames:
+// the source palette, if the model was trained from a paletted image, or
+// otherwise a palette built from the model's distinct observed colors,
+// falling back to the standard Plan9 palette once there are more than 256 of
+// them to fit in a GIF frame.
+func (m *markov) framePalette() color.Palette {
+	if m.palette != nil {
+		return m.palette
+	}
+	if len(m.keys) <= 256 {
+		p := make(color.Palette, len(m.keys))
+		for i, k := range m.keys {
+			p[i] = m.decodeColor(k)
+		}
+		return p
+	}
+	return palette.Plan9
+}
+
+// quantizeFrame copies src into a new Paletted image using p, letting
+// image.Paletted.Set resolve each pixel to its nearest palette entry.
+func quantizeFrame(src image.Image, p color.Palette) *image.Paletted {
+	b := src.Bounds()
+	dst := image.NewPaletted(b, p)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			dst.Set(x, y, src.At(x, y))
+		}
+	}
+	return dst
+}
+
+// lastPixel returns the color of im's bottom-right pixel, the last one
+// Generate's raster-order walk draws.
+func lastPixel(im image.Image) color.Color {
+	b := im.Bounds()
+	return im.At(b.Max.X-1, b.Max.Y-1)
+}
+
+// generate returns a new image generated from the current model. If seed is
+// non-nil, it primes the first (top-left) pixel instead of drawing it from the
+// transitions observed with no in-bounds context neighbors, for temporal
+// continuity between animation frames.
+func (m *markov) generate(seed color.Color) image.Image {
+	if m.palette != nil {
+		return m.generatePaletted(seed)
+	}
+	return m.generateRGBA(seed)
+}
+
+// context returns the colors of p's context neighbors that fall within get's
+// bounds, in contextOffsets order, for use as the conditioning context of p.
+func (m *markov) context(p image.Point, get func(image.Point) (color.Color, bool)) []color.Color {
+	context := make([]color.Color, m.order)
+	for i := 0; i < m.order; i++ {
+		np := p.Add(contextOffsets[i])
+		if c, ok := get(np); ok {
+			context[i] = c
+		}
+	}
+	return context
+}
+
+// inBounds reports whether p falls within the model's boundaries.
+func (m *markov) inBounds(p image.Point) bool {
+	return p.X >= m.MinX() && p.X < m.MaxX() &&
+		p.Y >= m.MinY() && p.Y < m.MaxY()
+}
+
+// generateRGBA generates a new RGBA image from the current model, walking
+// the canvas in raster order so every context neighbor is already coloured
+// by the time it is read.
+func (m *markov) generateRGBA(seed color.Color) *image.RGBA {
+	im := image.NewRGBA(m.bounds)
+	for y := m.MinY(); y < m.MaxY(); y++ {
+		for x := m.MinX(); x < m.MaxX(); x++ {
+			p := image.Point{X: x, Y: y}
+			var c color.Color
+			if seed != nil && x == m.MinX() && y == m.MinY() {
+				c = seed
+			} else {
+				context := m.context(p, func(np image.Point) (color.Color, bool) {
+					if !m.inBounds(np) {
+						return nil, false
+					}
+					return im.At(np.X, np.Y), true
+				})
+				c = m.GetNextColor(context)
+			}
+			im.SetRGBA(p.X, p.Y, colorToRGBA(c))
+		}
+	}
+	return im
+}
+
+// generatePaletted generates a new paletted image from the current model,
+// preserving the source image's palette, walking the canvas in raster order
+// so every context neighbor is already coloured by the time it is read.
+func (m *markov) generatePaletted(seed color.Color) *image.Paletted {
+	im := image.NewPaletted(m.bounds, m.palette)
+	for y := m.MinY(); y < m.MaxY(); y++ {
+		for x := m.MinX(); x < m.MaxX(); x++ {
+			p := image.Point{X: x, Y: y}
+			var c color.Color
+			if seed != nil && x == m.MinX() && y == m.MinY() {
+				c = seed
+			} else {
+				context := m.context(p, func(np image.Point) (color.Color, bool) {
+					if !m.inBounds(np) {
+						return nil, false
+					}
+					return im.At(np.X, np.Y), true
+				})
+				c = m.GetNextColor(context)
 			}
+			im.Set(p.X, p.Y, c)
 		}
 	}
 	return im
 }
 
-// ReadFile reads the given image file and sets the model accordingly.
+// ReadFile reads the given image file and adds it to the model.
 func (m *markov) ReadFile(filename string) error {
-	f, err := os.Open(filename)
+	return m.ReadFiles(filename)
+}
+
+// ReadFiles reads each given image file and adds it to the model, so a
+// single model can be trained from a corpus of multiple images.
+func (m *markov) ReadFiles(filenames ...string) error {
+	for _, filename := range filenames {
+		if err := m.readFile(filename); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readFile decodes a single image file and adds it to the model. The file is
+// read into memory up front so its raw bytes can be scanned for an Exif
+// orientation tag alongside being decoded as an image.
+func (m *markov) readFile(filename string) error {
+	data, err := os.ReadFile(filename)
 	if err != nil {
 		return err
 	}
-	defer f.Close()
-	im, format, err := image.Decode(f)
+	im, format, err := image.Decode(bytes.NewReader(data))
 	if err != nil {
 		return err
 	}
@@ -151,27 +554,228 @@ func (m *markov) ReadFile(filename string) error {
 			format,
 		)
 	}
-	m.format = format
-	m.bounds = im.Bounds()
-	// for each pixel sample its color and add its color tranistions to the
-	// model
-	for x := m.MinX(); x < m.MaxX(); x++ {
-		for y := m.MinY(); y < m.MaxY(); y++ {
+	// correct for any embedded orientation tag so the trained context
+	// directions (N/W/NW/NE) are meaningful
+	if o := readExifOrientation(data); o != orientationNone {
+		im = autoOrient(im, o)
+	}
+	m.recordFormat(format)
+	return m.AddImage(im)
+}
+
+// recordFormat records an observation of format, and sets m.format to
+// whichever format has been observed the most across the corpus so far, for
+// WriteFile to use once training mixes formats.
+func (m *markov) recordFormat(format string) {
+	m.recordFormatCount(format, 1)
+}
+
+// AddImage adds the transitions observed in img to the model. Its bounds are
+// unioned into the model's output bounds, unless SetBounds was called
+// explicitly, and its palette is adopted if this is the first image trained;
+// a later image with a different (or absent) palette falls the model back to
+// packed RGBA keying, since palette indices are only comparable within a
+// single palette. Any transitions already recorded under an abandoned
+// palette are re-encoded into the new scheme, so falling back never orphans
+// earlier training data.
+func (m *markov) AddImage(img image.Image) error {
+	old := m.palette
+	if p, ok := img.ColorModel().(color.Palette); ok {
+		switch {
+		case m.palette == nil && len(m.keys) == 0:
+			m.palette = p
+		case m.palette == nil || !paletteEqual(m.palette, p):
+			m.palette = nil
+		}
+	} else if m.palette != nil {
+		m.palette = nil
+	}
+	if old != nil && m.palette == nil {
+		m.retranslateOwnKeys(old)
+	}
+	b := img.Bounds()
+	if !m.boundsLocked {
+		if !m.boundsSet {
+			m.bounds = b
+			m.boundsSet = true
+		} else {
+			m.bounds = m.bounds.Union(b)
+		}
+	}
+	inBounds := func(p image.Point) bool {
+		return p.X >= b.Min.X && p.X < b.Max.X && p.Y >= b.Min.Y && p.Y < b.Max.Y
+	}
+	// walk the image in the same raster order Generate uses, so for each
+	// pixel its context neighbors have already been sampled, and record the
+	// context -> color observation
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
 			p := image.Point{X: x, Y: y}
-			c := im.At(p.X, p.Y)
-			for _, adj := range adjacent {
-				p := p.Add(adj)
-				if p.X >= m.MinX() && p.X < m.MaxX() &&
-					p.Y >= m.MinY() && p.Y < m.MaxY() {
-					c_ := im.At(p.X, p.Y)
-					m.AddColorTransition(c, c_)
+			c := img.At(p.X, p.Y)
+			context := m.context(p, func(np image.Point) (color.Color, bool) {
+				if !inBounds(np) {
+					return nil, false
 				}
+				return img.At(np.X, np.Y), true
+			})
+			m.AddTransition(context, c)
+		}
+	}
+	return nil
+}
+
+// retranslateOwnKeys re-encodes m's own keys and model entries, previously
+// encoded under old (m's just-abandoned palette), into m's current encoding
+// scheme. Without this, transitions recorded under a dropped palette would
+// become unreachable: their small palette-index keys would be misdecoded
+// under the new scheme instead of being translated into it, silently
+// dropping training data.
+func (m *markov) retranslateOwnKeys(old color.Palette) {
+	translate := func(k uint32) uint32 {
+		return m.encodeColor(old[k])
+	}
+	keys := make([]uint32, 0, len(m.keys))
+	seen := make(map[uint32]bool, len(m.seen))
+	for _, k := range m.keys {
+		tk := translate(k)
+		if !seen[tk] {
+			seen[tk] = true
+			keys = append(keys, tk)
+		}
+	}
+	m.keys = keys
+	m.seen = seen
+
+	model := make(stateSpace, len(m.model))
+	for key, entry := range m.model {
+		var tkey stateKey
+		for i, k := range key {
+			if k == noNeighbor {
+				tkey[i] = noNeighbor
+			} else {
+				tkey[i] = translate(k)
 			}
 		}
+		dst, ok := model[tkey]
+		if !ok {
+			dst = newTransitionCounts()
+			model[tkey] = dst
+		}
+		for next, count := range entry.counts {
+			dst.counts[translate(next)] += count
+		}
+		dst.stale = true
+	}
+	m.model = model
+}
+
+// paletteEqual reports whether two palettes have the same colors in the same
+// order.
+func paletteEqual(a, b color.Palette) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Merge combines other's transitions, distinct colors and boundaries into m,
+// for combining models trained independently (e.g. in parallel across
+// goroutines on a large corpus). Both models must share the same order. Any
+// of m's own transitions already recorded under an abandoned palette are
+// re-encoded into the new scheme, so merging never orphans m's own earlier
+// training data.
+func (m *markov) Merge(other Markov) error {
+	o, ok := other.(*markov)
+	if !ok {
+		return fmt.Errorf("cannot merge markov model with type %T", other)
+	}
+	if m.order != o.order {
+		return fmt.Errorf(
+			"cannot merge models with different orders: %d != %d",
+			m.order, o.order,
+		)
+	}
+	old := m.palette
+	if o.palette != nil {
+		switch {
+		case m.palette == nil && len(m.keys) == 0:
+			m.palette = o.palette
+		case m.palette == nil || !paletteEqual(m.palette, o.palette):
+			m.palette = nil
+		}
+	} else if m.palette != nil {
+		m.palette = nil
+	}
+	if old != nil && m.palette == nil {
+		m.retranslateOwnKeys(old)
+	}
+	if !m.boundsLocked {
+		if !m.boundsSet {
+			m.bounds = o.bounds
+			m.boundsSet = o.boundsSet
+		} else if !o.boundsLocked {
+			m.bounds = m.bounds.Union(o.bounds)
+		}
+	}
+	for f, c := range o.formatCounts {
+		m.recordFormatCount(f, c)
+	}
+	// translate re-encodes one of o's keys under m's (possibly just-adopted
+	// or just-dropped) encoding scheme, so merged keys remain comparable even
+	// when m and o disagree on palette use.
+	translate := func(k uint32) uint32 {
+		return m.encodeColor(o.decodeColor(k))
+	}
+	for _, k := range o.keys {
+		tk := translate(k)
+		if !m.seen[tk] {
+			m.seen[tk] = true
+			m.keys = append(m.keys, tk)
+		}
+	}
+	for key, entry := range o.model {
+		var tkey stateKey
+		for i, k := range key {
+			if k == noNeighbor {
+				tkey[i] = noNeighbor
+			} else {
+				tkey[i] = translate(k)
+			}
+		}
+		dst, ok := m.model[tkey]
+		if !ok {
+			dst = newTransitionCounts()
+			m.model[tkey] = dst
+		}
+		for next, count := range entry.counts {
+			dst.counts[translate(next)] += count
+		}
+		dst.stale = true
 	}
 	return nil
 }
 
+// recordFormatCount adds count observations of format, keeping m.format set
+// to whichever format has been observed the most.
+func (m *markov) recordFormatCount(format string, count int) {
+	if m.formatCounts == nil {
+		m.formatCounts = make(map[string]int)
+	}
+	m.formatCounts[format] += count
+	best, bestCount := m.format, m.formatCounts[m.format]
+	for f, c := range m.formatCounts {
+		if c > bestCount {
+			best, bestCount = f, c
+		}
+	}
+	m.format = best
+}
+
 // WriteFile generates a new image based on the current model and writes it to
 // the given file path.
 func (m *markov) WriteFile(filename string) error {
@@ -179,22 +783,32 @@ func (m *markov) WriteFile(filename string) error {
 	if err != nil {
 		return err
 	}
-	d := m.Generate()
+	defer o.Close()
+	if strings.HasSuffix(filename, ".gif") {
+		return m.writeGIF(o)
+	}
 	switch m.format {
 	case "png":
-		png.Encode(o, d)
+		return png.Encode(o, m.Generate())
 	// TODO readds these once they are supported... sorry :(
 	// case "jpeg":
 	//	jpeg.Encode(o, d, nil)
-	// case "gif":
-	//	gif.Encode(o, d, nil)
 	default:
 		return fmt.Errorf(
 			"file format \"%s\" not supported; supported formats are: \"png\"",
 			m.format,
 		)
 	}
-	return nil
+}
+
+// writeGIF encodes either a single-frame or, when SetAnimation was called
+// with a positive frame count, an animated GIF to o.
+func (m *markov) writeGIF(o *os.File) error {
+	if m.animFrames > 0 {
+		return gif.EncodeAll(o, m.GenerateAnimation(m.animFrames, m.animDelay))
+	}
+	frame := quantizeFrame(m.Generate(), m.framePalette())
+	return gif.Encode(o, frame, nil)
 }
 
 // MinX returns the lower X coordinate boundary of the image.
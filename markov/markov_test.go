@@ -0,0 +1,520 @@
+package markov
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/gif"
+	"image/png"
+	mrand "math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// newTestPNG writes a synthetic, colorful PNG of the given size to dir and
+// returns its path. The pattern mixes many distinct colors so the resulting
+// state space is representative of real training data.
+func newTestPNG(t testing.TB, dir string, size int) string {
+	t.Helper()
+	im := image.NewRGBA(image.Rect(0, 0, size, size))
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			im.Set(x, y, color.RGBA{
+				R: uint8((x * 7) % 256),
+				G: uint8((y * 13) % 256),
+				B: uint8((x + y) % 256),
+				A: 255,
+			})
+		}
+	}
+	path := filepath.Join(dir, "bench.png")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("failed to create test PNG: %s", err)
+	}
+	defer f.Close()
+	if err := png.Encode(f, im); err != nil {
+		t.Fatalf("failed to encode test PNG: %s", err)
+	}
+	return path
+}
+
+// BenchmarkReadFile measures the cost of training a model from a
+// representative image under the current weighted-count state space, whose
+// memory is proportional to the number of distinct transitions observed
+// rather than to pixel count. It only covers the current implementation, not
+// a before/after comparison against the duplicate-slice storage it replaced
+// (which was removed in the same change, so there is nothing left in this
+// tree to run it against).
+func BenchmarkReadFile(b *testing.B) {
+	path := newTestPNG(b, b.TempDir(), 256)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m := New()
+		if err := m.ReadFile(path); err != nil {
+			b.Fatalf("ReadFile failed: %s", err)
+		}
+	}
+}
+
+// BenchmarkGetNextColor measures the cost of a single weighted draw, via the
+// cumulative-weight binary search, once a model is trained. As with
+// BenchmarkReadFile, this only covers the current implementation; the
+// duplicate-slice pick it replaced is gone from this tree, so there is no
+// before/after comparison to run here.
+func BenchmarkGetNextColor(b *testing.B) {
+	path := newTestPNG(b, b.TempDir(), 256)
+	m := New()
+	if err := m.ReadFile(path); err != nil {
+		b.Fatalf("ReadFile failed: %s", err)
+	}
+	context := []color.Color{color.RGBA{R: 14, G: 0, B: 14, A: 255}}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m.GetNextColor(context)
+	}
+}
+
+// newTestPalette returns a small, distinct color.Palette for paletted test
+// fixtures.
+func newTestPalette() color.Palette {
+	return color.Palette{
+		color.RGBA{R: 255, A: 255},
+		color.RGBA{G: 255, A: 255},
+		color.RGBA{B: 255, A: 255},
+		color.RGBA{R: 255, G: 255, A: 255},
+	}
+}
+
+// newTestPalettedPNG writes a synthetic paletted PNG of the given size,
+// indexing every pixel into p by (x+y)%len(p), to dir and returns its path.
+func newTestPalettedPNG(t testing.TB, dir string, size int, p color.Palette) string {
+	t.Helper()
+	im := image.NewPaletted(image.Rect(0, 0, size, size), p)
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			im.SetColorIndex(x, y, uint8((x+y)%len(p)))
+		}
+	}
+	path := filepath.Join(dir, "paletted.png")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("failed to create test PNG: %s", err)
+	}
+	defer f.Close()
+	if err := png.Encode(f, im); err != nil {
+		t.Fatalf("failed to encode test PNG: %s", err)
+	}
+	return path
+}
+
+// TestTransitionCountsPick verifies that pick's cumulative-weight binary
+// search resolves every draw in [0, total) to the color key whose observed
+// count covers that draw, and that ensureFresh's cache is deterministic
+// across rebuilds of the same counts.
+func TestTransitionCountsPick(t *testing.T) {
+	tc := newTransitionCounts()
+	tc.observe(10)
+	tc.observe(10)
+	tc.observe(10)
+	tc.observe(20)
+	tc.observe(30)
+	tc.observe(30)
+	tc.ensureFresh()
+
+	if tc.total != 6 {
+		t.Fatalf("total = %d, want 6", tc.total)
+	}
+	want := map[uint32]int{10: 3, 20: 1, 30: 2}
+	got := make(map[uint32]int)
+	for draw := uint32(0); draw < tc.total; draw++ {
+		got[tc.pick(draw)]++
+	}
+	for k, n := range want {
+		if got[k] != n {
+			t.Errorf("pick covered key %d %d times, want %d", k, got[k], n)
+		}
+	}
+
+	// Rebuilding from the same counts must reproduce the same cache.
+	tc.stale = true
+	firstColors, firstCum := append([]uint32(nil), tc.colors...), append([]uint32(nil), tc.cum...)
+	tc.ensureFresh()
+	if !reflect.DeepEqual(firstColors, tc.colors) || !reflect.DeepEqual(firstCum, tc.cum) {
+		t.Fatalf("ensureFresh rebuilt a different cache: colors %v/%v, cum %v/%v",
+			firstColors, tc.colors, firstCum, tc.cum)
+	}
+}
+
+// TestGetNextColorTracksObservedWeights verifies that GetNextColor's draws
+// approximate the proportions actually observed for a context, rather than
+// picking uniformly among distinct next colors.
+func TestGetNextColorTracksObservedWeights(t *testing.T) {
+	m := newMarkov(1, mathRNG{mrand.New(mrand.NewSource(7))})
+	context := []color.Color{color.RGBA{R: 1, A: 255}}
+	common := color.RGBA{R: 2, A: 255}
+	rare := color.RGBA{R: 3, A: 255}
+	for i := 0; i < 90; i++ {
+		m.AddTransition(context, common)
+	}
+	for i := 0; i < 10; i++ {
+		m.AddTransition(context, rare)
+	}
+
+	const draws = 10000
+	var commonCount int
+	for i := 0; i < draws; i++ {
+		if m.GetNextColor(context) == color.Color(common) {
+			commonCount++
+		}
+	}
+	got := float64(commonCount) / draws
+	if got < 0.85 || got > 0.95 {
+		t.Fatalf("common color drawn %.3f of the time, want ~0.90 (observed 90%%/10%% split)", got)
+	}
+}
+
+// TestReadFilesUnionsBounds verifies that ReadFiles, trained on
+// differently-sized images, sets the model's output bounds to their union
+// rather than any single image's bounds.
+func TestReadFilesUnionsBounds(t *testing.T) {
+	dir := t.TempDir()
+	small := newTestPNG(t, dir, 8)
+	large := filepath.Join(dir, "large.png")
+	im := image.NewRGBA(image.Rect(0, 0, 20, 12))
+	f, err := os.Create(large)
+	if err != nil {
+		t.Fatalf("failed to create test PNG: %s", err)
+	}
+	if err := png.Encode(f, im); err != nil {
+		t.Fatalf("failed to encode test PNG: %s", err)
+	}
+	f.Close()
+
+	m := New().(*markov)
+	if err := m.ReadFiles(small, large); err != nil {
+		t.Fatalf("ReadFiles failed: %s", err)
+	}
+	want := image.Rect(0, 0, 20, 12)
+	if m.bounds != want {
+		t.Fatalf("bounds = %v, want %v", m.bounds, want)
+	}
+}
+
+// TestSetBoundsLocksAgainstAddImage verifies that an explicit SetBounds call
+// is not overridden by the bounds of images trained afterward.
+func TestSetBoundsLocksAgainstAddImage(t *testing.T) {
+	m := New().(*markov)
+	locked := image.Rect(0, 0, 5, 5)
+	m.SetBounds(locked)
+
+	img := image.NewRGBA(image.Rect(0, 0, 50, 50))
+	if err := m.AddImage(img); err != nil {
+		t.Fatalf("AddImage failed: %s", err)
+	}
+	if m.bounds != locked {
+		t.Fatalf("bounds = %v, want locked bounds %v", m.bounds, locked)
+	}
+}
+
+// TestRecordFormatCountTracksMajority verifies that the model's format
+// tracks whichever file format has been trained the most, even once a
+// minority format is observed afterward.
+func TestRecordFormatCountTracksMajority(t *testing.T) {
+	m := New().(*markov)
+	m.recordFormatCount("png", 3)
+	m.recordFormatCount("jpeg", 1)
+	if m.format != "png" {
+		t.Fatalf("format = %q, want \"png\"", m.format)
+	}
+	m.recordFormatCount("jpeg", 5)
+	if m.format != "jpeg" {
+		t.Fatalf("format = %q, want \"jpeg\" after it became the majority", m.format)
+	}
+}
+
+// TestMergeUnionsBoundsAndTransitions verifies that Merge unions two models'
+// bounds and combines their transition counts for a context observed by
+// both.
+func TestMergeUnionsBoundsAndTransitions(t *testing.T) {
+	a := newMarkov(1, cryptoRNG{})
+	a.bounds = image.Rect(0, 0, 4, 4)
+	a.boundsSet = true
+	context := []color.Color{color.RGBA{R: 1, A: 255}}
+	next := color.RGBA{R: 2, A: 255}
+	a.AddTransition(context, next)
+
+	b := newMarkov(1, cryptoRNG{})
+	b.bounds = image.Rect(2, 2, 10, 6)
+	b.boundsSet = true
+	b.AddTransition(context, next)
+
+	if err := a.Merge(b); err != nil {
+		t.Fatalf("Merge failed: %s", err)
+	}
+	wantBounds := image.Rect(0, 0, 10, 6)
+	if a.bounds != wantBounds {
+		t.Fatalf("bounds = %v, want %v", a.bounds, wantBounds)
+	}
+	key := a.contextKey(context)
+	entry := a.model[key]
+	if entry == nil {
+		t.Fatalf("no transitions recorded for merged context")
+	}
+	if got := entry.counts[a.encodeColor(next)]; got != 2 {
+		t.Fatalf("merged transition count = %d, want 2", got)
+	}
+}
+
+// TestAddImageRetranslatesOwnKeysOnPaletteDrop verifies that a model's own
+// transitions, recorded while it still had a palette, remain retrievable
+// after a later image with no palette drops the model back to packed-RGBA
+// keying.
+func TestAddImageRetranslatesOwnKeysOnPaletteDrop(t *testing.T) {
+	p := newTestPalette()
+	m := newMarkov(1, cryptoRNG{})
+	context := []color.Color{p[0]}
+	paletted := image.NewPaletted(image.Rect(0, 0, 1, 1), p)
+	if err := m.AddImage(paletted); err != nil {
+		t.Fatalf("AddImage(paletted) failed: %s", err)
+	}
+	m.AddTransition(context, p[1])
+
+	rgba := image.NewRGBA(image.Rect(0, 0, 1, 1))
+	if err := m.AddImage(rgba); err != nil {
+		t.Fatalf("AddImage(rgba) failed: %s", err)
+	}
+	if m.palette != nil {
+		t.Fatalf("model kept a palette after training on a non-paletted image")
+	}
+
+	key := m.contextKey(context)
+	entry := m.model[key]
+	if entry == nil {
+		t.Fatalf("original paletted transition is unreachable after the palette was dropped")
+	}
+	if got := entry.counts[m.encodeColor(p[1])]; got != 1 {
+		t.Fatalf("retranslated transition count = %d, want 1", got)
+	}
+}
+
+// TestMergeRetranslatesOwnKeysOnPaletteDrop verifies that a model's own
+// transitions, recorded while it still had a palette, remain retrievable
+// after merging in another model with no palette drops it back to
+// packed-RGBA keying.
+func TestMergeRetranslatesOwnKeysOnPaletteDrop(t *testing.T) {
+	p := newTestPalette()
+	m := newMarkov(1, cryptoRNG{})
+	m.palette = p
+	context := []color.Color{p[0]}
+	m.AddTransition(context, p[1])
+
+	other := newMarkov(1, cryptoRNG{})
+	other.AddTransition([]color.Color{color.RGBA{R: 9, A: 255}}, color.RGBA{R: 10, A: 255})
+
+	if err := m.Merge(other); err != nil {
+		t.Fatalf("Merge failed: %s", err)
+	}
+	if m.palette != nil {
+		t.Fatalf("model kept a palette after merging in a non-paletted model")
+	}
+
+	key := m.contextKey(context)
+	entry := m.model[key]
+	if entry == nil {
+		t.Fatalf("original paletted transition is unreachable after the palette was dropped")
+	}
+	if got := entry.counts[m.encodeColor(p[1])]; got != 1 {
+		t.Fatalf("retranslated transition count = %d, want 1", got)
+	}
+}
+
+// TestMergeReconcilesPaletteMismatch verifies that merging a paletted model
+// into a non-paletted one falls the result back to packed-RGBA keying, and
+// that the paletted model's transitions are translated correctly so they
+// remain resolvable under the merged (non-paletted) encoding.
+func TestMergeReconcilesPaletteMismatch(t *testing.T) {
+	p := newTestPalette()
+
+	paletted := newMarkov(1, cryptoRNG{})
+	paletted.palette = p
+	pContext := []color.Color{p[0]}
+	paletted.AddTransition(pContext, p[1])
+
+	rgba := newMarkov(1, cryptoRNG{})
+	rgbaContext := []color.Color{color.RGBA{R: 9, A: 255}}
+	rgba.AddTransition(rgbaContext, color.RGBA{R: 10, A: 255})
+
+	if err := rgba.Merge(paletted); err != nil {
+		t.Fatalf("Merge failed: %s", err)
+	}
+	if rgba.palette != nil {
+		t.Fatalf("merged model kept a palette, want packed-RGBA fallback after a palette mismatch")
+	}
+
+	key := rgba.contextKey(pContext)
+	entry := rgba.model[key]
+	if entry == nil {
+		t.Fatalf("no transitions recorded for the translated paletted context")
+	}
+	if got := entry.counts[rgba.encodeColor(p[1])]; got != 1 {
+		t.Fatalf("translated transition count = %d, want 1", got)
+	}
+}
+
+// TestGeneratePalettedPreservesPalette verifies that training from a
+// paletted source image keeps Generate on the palette-index fast path, that
+// the generated image carries the same palette as the source, and that the
+// result round-trips through WriteFile/decode without losing its palette.
+func TestGeneratePalettedPreservesPalette(t *testing.T) {
+	p := newTestPalette()
+	path := newTestPalettedPNG(t, t.TempDir(), 16, p)
+
+	m := New()
+	if err := m.ReadFile(path); err != nil {
+		t.Fatalf("ReadFile failed: %s", err)
+	}
+
+	generated := m.Generate()
+	paletted, ok := generated.(*image.Paletted)
+	if !ok {
+		t.Fatalf("Generate() returned %T, want *image.Paletted", generated)
+	}
+	if !paletteEqual(paletted.Palette, p) {
+		t.Fatalf("Generate() palette = %v, want %v", paletted.Palette, p)
+	}
+
+	outPath := filepath.Join(t.TempDir(), "out.png")
+	if err := m.WriteFile(outPath); err != nil {
+		t.Fatalf("WriteFile failed: %s", err)
+	}
+	outFile, err := os.Open(outPath)
+	if err != nil {
+		t.Fatalf("failed to open written file: %s", err)
+	}
+	defer outFile.Close()
+	decoded, err := png.Decode(outFile)
+	if err != nil {
+		t.Fatalf("failed to decode written file: %s", err)
+	}
+	decodedPaletted, ok := decoded.(*image.Paletted)
+	if !ok {
+		t.Fatalf("WriteFile output decoded to %T, want *image.Paletted", decoded)
+	}
+	if !paletteEqual(decodedPaletted.Palette, p) {
+		t.Fatalf("written file palette = %v, want %v", decodedPaletted.Palette, p)
+	}
+}
+
+// TestGenerateSeededIsDeterministic verifies that a model created with
+// NewWithSeed produces byte-identical PNG output across independent runs
+// trained on the same source image.
+func TestGenerateSeededIsDeterministic(t *testing.T) {
+	path := newTestPNG(t, t.TempDir(), 32)
+	render := func() []byte {
+		m := NewWithSeed(42)
+		if err := m.ReadFile(path); err != nil {
+			t.Fatalf("ReadFile failed: %s", err)
+		}
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, m.Generate()); err != nil {
+			t.Fatalf("png.Encode failed: %s", err)
+		}
+		return buf.Bytes()
+	}
+	first := render()
+	second := render()
+	if !bytes.Equal(first, second) {
+		t.Fatalf("NewWithSeed(42) produced different output across runs")
+	}
+}
+
+// TestWriteFileGIFHonorsSetAnimation verifies that WriteFile to a ".gif" path
+// produces a multi-frame GIF whose frame count and per-frame delay match the
+// arguments given to SetAnimation.
+func TestWriteFileGIFHonorsSetAnimation(t *testing.T) {
+	path := newTestPNG(t, t.TempDir(), 16)
+	m := NewWithSeed(1)
+	if err := m.ReadFile(path); err != nil {
+		t.Fatalf("ReadFile failed: %s", err)
+	}
+	m.SetAnimation(5, 20)
+
+	outPath := filepath.Join(t.TempDir(), "out.gif")
+	if err := m.WriteFile(outPath); err != nil {
+		t.Fatalf("WriteFile failed: %s", err)
+	}
+	f, err := os.Open(outPath)
+	if err != nil {
+		t.Fatalf("failed to open written file: %s", err)
+	}
+	defer f.Close()
+	g, err := gif.DecodeAll(f)
+	if err != nil {
+		t.Fatalf("failed to decode written GIF: %s", err)
+	}
+	if len(g.Image) != 5 {
+		t.Fatalf("got %d frames, want 5", len(g.Image))
+	}
+	for i, delay := range g.Delay {
+		if delay != 20 {
+			t.Errorf("frame %d delay = %d, want 20", i, delay)
+		}
+	}
+}
+
+// TestWriteFileGIFWithoutAnimationIsSingleFrame verifies that WriteFile to a
+// ".gif" path produces a single-frame GIF when SetAnimation was never called.
+func TestWriteFileGIFWithoutAnimationIsSingleFrame(t *testing.T) {
+	path := newTestPNG(t, t.TempDir(), 16)
+	m := New()
+	if err := m.ReadFile(path); err != nil {
+		t.Fatalf("ReadFile failed: %s", err)
+	}
+
+	outPath := filepath.Join(t.TempDir(), "out.gif")
+	if err := m.WriteFile(outPath); err != nil {
+		t.Fatalf("WriteFile failed: %s", err)
+	}
+	f, err := os.Open(outPath)
+	if err != nil {
+		t.Fatalf("failed to open written file: %s", err)
+	}
+	defer f.Close()
+	g, err := gif.DecodeAll(f)
+	if err != nil {
+		t.Fatalf("failed to decode written GIF: %s", err)
+	}
+	if len(g.Image) != 1 {
+		t.Fatalf("got %d frames, want 1", len(g.Image))
+	}
+}
+
+// TestFramePaletteFallsBackToPlan9 verifies that framePalette falls back to
+// the standard Plan9 palette once a model's distinct observed colors exceed
+// the 256 a GIF frame can index.
+func TestFramePaletteFallsBackToPlan9(t *testing.T) {
+	m := newMarkov(1, mathRNG{mrand.New(mrand.NewSource(1))})
+	context := []color.Color{nil}
+	for i := 0; i < 300; i++ {
+		m.AddTransition(context, color.RGBA{R: uint8(i), G: uint8(i / 2), B: uint8(i / 3), A: 255})
+	}
+	p := m.framePalette()
+	if len(m.keys) <= 256 {
+		t.Fatalf("test setup error: only got %d distinct colors, want > 256", len(m.keys))
+	}
+	if len(p) != len(palette.Plan9) {
+		t.Fatalf("framePalette() returned a palette of length %d, want the Plan9 palette (%d)",
+			len(p), len(palette.Plan9))
+	}
+	for i := range palette.Plan9 {
+		if p[i] != palette.Plan9[i] {
+			t.Fatalf("framePalette()[%d] = %v, want %v", i, p[i], palette.Plan9[i])
+		}
+	}
+}